@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	metricVaultSealed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vault_sealed",
+		Help: "1 if Vault is currently sealed, 0 otherwise",
+	})
+	metricUnsealAttemptsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vault_unseal_attempts_total",
+		Help: "Number of times an unseal has been attempted",
+	})
+	metricUnsealErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vault_unseal_errors_total",
+		Help: "Number of unseal attempts that failed",
+	})
+	metricLastSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vault_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful seal-status reconciliation",
+	})
+)
+
+// Daemon runs reconcile on a timer for as long as the process lives,
+// re-unsealing Vault whenever it reports sealed, and serves /healthz,
+// /readyz and /metrics so the controller can be probed and scraped in
+// cluster.
+type Daemon struct {
+	vault             *VaultClient
+	clientset         *kubernetes.Clientset
+	protector         KeyProtector
+	shareDestinations []ShareDestination
+	pollInterval      time.Duration
+	inputFile         string
+	k8sNs             string
+	k8sName           string
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+}
+
+// NewDaemon builds a Daemon that reconciles Vault's seal status every
+// pollInterval, reading unseal keys from inputFile, the given k8s
+// secret, or shareDestinations depending on how the tool was configured.
+func NewDaemon(vault *VaultClient, clientset *kubernetes.Clientset, protector KeyProtector, shareDestinations []ShareDestination, pollInterval time.Duration, inputFile, k8sNs, k8sName string) *Daemon {
+	return &Daemon{
+		vault:             vault,
+		clientset:         clientset,
+		protector:         protector,
+		shareDestinations: shareDestinations,
+		pollInterval:      pollInterval,
+		inputFile:         inputFile,
+		k8sNs:             k8sNs,
+		k8sName:           k8sName,
+	}
+}
+
+// ServeHTTP registers /healthz, /readyz and /metrics on addr and serves
+// them in the background. It returns once the listener is up.
+func (d *Daemon) ServeHTTP(addr string) error {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if d.ready() {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintln(w, "ok")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "not ready")
+	})
+
+	mux.Handle("/metrics", promhttp.Handler())
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", addr, err)
+	}
+
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Printf("health/metrics server stopped: %s\n", err)
+		}
+	}()
+
+	return nil
+}
+
+func (d *Daemon) ready() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.lastSuccess.IsZero() {
+		return false
+	}
+	return time.Since(d.lastSuccess) < 2*d.pollInterval
+}
+
+func (d *Daemon) markSuccess(t time.Time) {
+	d.mu.Lock()
+	d.lastSuccess = t
+	d.mu.Unlock()
+	metricLastSuccessTimestamp.Set(float64(t.Unix()))
+}
+
+// Run polls Vault's seal status every pollInterval and re-unseals it
+// whenever it comes back sealed, applying exponential backoff between
+// retries when reconcile fails. It blocks until ctx is cancelled.
+func (d *Daemon) Run(ctx context.Context) error {
+	backoff := d.pollInterval
+	const maxBackoff = 5 * time.Minute
+
+	for {
+		status, err := reconcile(d.vault, d.clientset, d.protector, d.shareDestinations, d.inputFile, d.k8sNs, d.k8sName)
+		if err != nil {
+			var uErr *unsealError
+			if errors.As(err, &uErr) {
+				metricUnsealErrorsTotal.Inc()
+			}
+			log.Printf("reconcile failed: %s\n", err)
+
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		} else {
+			backoff = d.pollInterval
+			d.markSuccess(time.Now())
+
+			// reconcile reports the seal status it observed before any
+			// unseal attempt, so right after a successful unseal that
+			// status is already stale. Re-read it so the gauge reflects
+			// where Vault actually ended up.
+			finalStatus, statusErr := d.vault.Status()
+			if statusErr != nil {
+				log.Printf("reconcile succeeded but could not refresh seal status for metrics: %s\n", statusErr)
+			} else {
+				status = finalStatus
+			}
+
+			if status.Sealed {
+				metricVaultSealed.Set(1)
+			} else {
+				metricVaultSealed.Set(0)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// envelope is the on-disk/on-secret representation of a KMS-protected
+// VaultInitResponse: a DEK wrapped by the configured KeyProtector, plus
+// the AES-256-GCM nonce and ciphertext of the marshalled response,
+// mirroring the envelope-encryption pattern used by ceph-csi and
+// sealed-secrets to keep secret material safe at rest.
+type envelope struct {
+	Provider   string `json:"provider"`
+	WrappedDEK string `json:"wrapped_dek"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// sealEnvelope generates a random 32-byte DEK, AES-256-GCM encrypts b
+// with it, wraps the DEK with protector and returns the marshalled
+// envelope.
+func sealEnvelope(ctx context.Context, protector KeyProtector, b []byte) ([]byte, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, fmt.Errorf("could not generate dek: %w", err)
+	}
+
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, fmt.Errorf("could not build aes cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not build gcm: %w", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, b, nil)
+
+	wrappedDEK, err := protector.WrapDEK(ctx, dek)
+	if err != nil {
+		return nil, fmt.Errorf("could not wrap dek: %w", err)
+	}
+
+	env := envelope{
+		Provider:   protector.Name(),
+		WrappedDEK: base64.StdEncoding.EncodeToString(wrappedDEK),
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}
+
+	return json.Marshal(&env)
+}
+
+// openEnvelope is the inverse of sealEnvelope: it unmarshals b into an
+// envelope, unwraps the DEK with protector and decrypts the ciphertext.
+func openEnvelope(ctx context.Context, protector KeyProtector, b []byte) ([]byte, error) {
+	var env envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("could not unmarshal envelope: %w", err)
+	}
+
+	if env.Provider != protector.Name() {
+		return nil, fmt.Errorf("envelope was sealed with provider %q, but kms-provider is %q", env.Provider, protector.Name())
+	}
+
+	wrappedDEK, err := base64.StdEncoding.DecodeString(env.WrappedDEK)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode wrapped dek: %w", err)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode nonce: %w", err)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(env.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode ciphertext: %w", err)
+	}
+
+	dek, err := protector.UnwrapDEK(ctx, wrappedDEK)
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap dek: %w", err)
+	}
+
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, fmt.Errorf("could not build aes cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not build gcm: %w", err)
+	}
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
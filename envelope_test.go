@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// fakeProtector is a no-op KeyProtector stand-in for exercising the
+// envelope seal/open round trip without talking to a real KMS.
+type fakeProtector struct {
+	name string
+}
+
+func (p *fakeProtector) Name() string { return p.name }
+
+func (p *fakeProtector) WrapDEK(ctx context.Context, dek []byte) ([]byte, error) {
+	wrapped := make([]byte, len(dek))
+	copy(wrapped, dek)
+	return wrapped, nil
+}
+
+func (p *fakeProtector) UnwrapDEK(ctx context.Context, wrapped []byte) ([]byte, error) {
+	dek := make([]byte, len(wrapped))
+	copy(dek, wrapped)
+	return dek, nil
+}
+
+func TestSealOpenEnvelopeRoundTrip(t *testing.T) {
+	protector := &fakeProtector{name: "fake"}
+	plaintext := []byte(`{"keys":["a","b"],"root_token":"s.deadbeef"}`)
+
+	sealed, err := sealEnvelope(context.Background(), protector, plaintext)
+	if err != nil {
+		t.Fatalf("sealEnvelope: %s", err)
+	}
+
+	opened, err := openEnvelope(context.Background(), protector, sealed)
+	if err != nil {
+		t.Fatalf("openEnvelope: %s", err)
+	}
+
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatalf("round trip mismatch: got %q, want %q", opened, plaintext)
+	}
+}
+
+func TestOpenEnvelopeProviderMismatch(t *testing.T) {
+	sealed, err := sealEnvelope(context.Background(), &fakeProtector{name: "fake"}, []byte("hello"))
+	if err != nil {
+		t.Fatalf("sealEnvelope: %s", err)
+	}
+
+	if _, err := openEnvelope(context.Background(), &fakeProtector{name: "other"}, sealed); err == nil {
+		t.Fatal("expected an error when the envelope's provider does not match")
+	}
+}
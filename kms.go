@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	gcpkms "cloud.google.com/go/kms/apiv1"
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"filippo.io/age"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azkeys"
+	"github.com/aws/aws-sdk-go-v2/config"
+	kmsv2 "github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// KeyProtector wraps and unwraps the random data-encryption-key (DEK)
+// used to envelope-encrypt the Vault init response, so the thing that
+// ends up on disk or in a k8s Secret is only recoverable by whoever
+// controls the wrapping key (a cloud KMS key or an age recipient; PGP
+// recipients are not supported), not by whoever can merely read the
+// Secret.
+type KeyProtector interface {
+	// Name identifies the provider, stored alongside the envelope so
+	// openEnvelope can reject an envelope sealed by a different provider
+	// than the configured one.
+	Name() string
+	WrapDEK(ctx context.Context, dek []byte) (wrapped []byte, err error)
+	UnwrapDEK(ctx context.Context, wrapped []byte) (dek []byte, err error)
+}
+
+// NewKeyProtector builds the KeyProtector for the given --kms-provider.
+// keyID is provider-specific: a key ARN for aws, a full CryptoKey
+// resource name for gcp, a key vault key URL for azure, and a
+// comma-separated list of age recipients for age. An empty provider
+// returns a nil KeyProtector, meaning "store the init response in
+// plaintext" (the pre-existing behaviour).
+func NewKeyProtector(provider, keyID, identityFile string) (KeyProtector, error) {
+	switch provider {
+	case "", "none":
+		return nil, nil
+	case "aws":
+		return newAWSKMSProtector(keyID)
+	case "gcp":
+		return newGCPKMSProtector(keyID)
+	case "azure":
+		return newAzureKeyVaultProtector(keyID)
+	case "age":
+		return newAgeProtector(keyID, identityFile)
+	default:
+		return nil, fmt.Errorf("unknown kms provider %q", provider)
+	}
+}
+
+type awsKMSProtector struct {
+	keyID  string
+	client *kmsv2.Client
+}
+
+func newAWSKMSProtector(keyID string) (*awsKMSProtector, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("kms-key-id is required for the aws kms provider")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not load aws config: %w", err)
+	}
+
+	return &awsKMSProtector{keyID: keyID, client: kmsv2.NewFromConfig(cfg)}, nil
+}
+
+func (p *awsKMSProtector) Name() string { return "aws" }
+
+func (p *awsKMSProtector) WrapDEK(ctx context.Context, dek []byte) ([]byte, error) {
+	out, err := p.client.Encrypt(ctx, &kmsv2.EncryptInput{
+		KeyId:     &p.keyID,
+		Plaintext: dek,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("aws kms encrypt: %w", err)
+	}
+	return out.CiphertextBlob, nil
+}
+
+func (p *awsKMSProtector) UnwrapDEK(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := p.client.Decrypt(ctx, &kmsv2.DecryptInput{
+		KeyId:          &p.keyID,
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("aws kms decrypt: %w", err)
+	}
+	return out.Plaintext, nil
+}
+
+type gcpKMSProtector struct {
+	keyName string
+	client  *gcpkms.KeyManagementClient
+}
+
+func newGCPKMSProtector(keyName string) (*gcpKMSProtector, error) {
+	if keyName == "" {
+		return nil, fmt.Errorf("kms-key-id is required for the gcp kms provider (expects a full CryptoKey resource name)")
+	}
+
+	client, err := gcpkms.NewKeyManagementClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not build gcp kms client: %w", err)
+	}
+
+	return &gcpKMSProtector{keyName: keyName, client: client}, nil
+}
+
+func (p *gcpKMSProtector) Name() string { return "gcp" }
+
+func (p *gcpKMSProtector) WrapDEK(ctx context.Context, dek []byte) ([]byte, error) {
+	resp, err := p.client.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:      p.keyName,
+		Plaintext: dek,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gcp kms encrypt: %w", err)
+	}
+	return resp.Ciphertext, nil
+}
+
+func (p *gcpKMSProtector) UnwrapDEK(ctx context.Context, wrapped []byte) ([]byte, error) {
+	resp, err := p.client.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:       p.keyName,
+		Ciphertext: wrapped,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gcp kms decrypt: %w", err)
+	}
+	return resp.Plaintext, nil
+}
+
+type azureKeyVaultProtector struct {
+	keyName string
+	client  *azkeys.Client
+}
+
+func newAzureKeyVaultProtector(keyID string) (*azureKeyVaultProtector, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("kms-key-id is required for the azure kms provider (expects https://<vault>.vault.azure.net/keys/<name>)")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(keyID, "https://"), "/keys/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("kms-key-id %q is not a valid key vault key URL", keyID)
+	}
+	vaultURL := "https://" + parts[0]
+
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not build azure credential: %w", err)
+	}
+
+	client, err := azkeys.NewClient(vaultURL, cred, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not build azure key vault client: %w", err)
+	}
+
+	return &azureKeyVaultProtector{keyName: parts[1], client: client}, nil
+}
+
+func (p *azureKeyVaultProtector) Name() string { return "azure" }
+
+func (p *azureKeyVaultProtector) WrapDEK(ctx context.Context, dek []byte) ([]byte, error) {
+	alg := azkeys.EncryptionAlgorithmRSAOAEP256
+	resp, err := p.client.WrapKey(ctx, p.keyName, "", azkeys.KeyOperationParameters{
+		Algorithm: &alg,
+		Value:     dek,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("azure key vault wrap: %w", err)
+	}
+	return resp.Result, nil
+}
+
+func (p *azureKeyVaultProtector) UnwrapDEK(ctx context.Context, wrapped []byte) ([]byte, error) {
+	alg := azkeys.EncryptionAlgorithmRSAOAEP256
+	resp, err := p.client.UnwrapKey(ctx, p.keyName, "", azkeys.KeyOperationParameters{
+		Algorithm: &alg,
+		Value:     wrapped,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("azure key vault unwrap: %w", err)
+	}
+	return resp.Result, nil
+}
+
+// ageProtector wraps the DEK for one or more age recipients (keyID, a
+// comma-separated list of age1... strings) so any one of their matching
+// identities can unwrap it. Unwrapping additionally requires
+// identityFile, an age identity file (as produced by age-keygen).
+type ageProtector struct {
+	recipients   []age.Recipient
+	identityFile string
+}
+
+func newAgeProtector(keyID, identityFile string) (*ageProtector, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("kms-key-id is required for the age provider (expects one or more comma-separated age recipients)")
+	}
+
+	var recipients []age.Recipient
+	for _, r := range strings.Split(keyID, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse age recipient %q: %w", r, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no valid age recipients in %q", keyID)
+	}
+
+	return &ageProtector{recipients: recipients, identityFile: identityFile}, nil
+}
+
+func (p *ageProtector) Name() string { return "age" }
+
+func (p *ageProtector) WrapDEK(ctx context.Context, dek []byte) ([]byte, error) {
+	var buf strings.Builder
+
+	w, err := age.Encrypt(&buf, p.recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("age encrypt: %w", err)
+	}
+	if _, err := w.Write(dek); err != nil {
+		return nil, fmt.Errorf("age encrypt: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("age encrypt: %w", err)
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString([]byte(buf.String()))), nil
+}
+
+func (p *ageProtector) UnwrapDEK(ctx context.Context, wrapped []byte) ([]byte, error) {
+	if p.identityFile == "" {
+		return nil, fmt.Errorf("kms-identity-file is required to unwrap an age-protected DEK")
+	}
+
+	identityBytes, err := os.ReadFile(p.identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read age identity file: %w", err)
+	}
+
+	identities, err := age.ParseIdentities(strings.NewReader(string(identityBytes)))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse age identities: %w", err)
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(string(wrapped))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode age envelope: %w", err)
+	}
+
+	r, err := age.Decrypt(strings.NewReader(string(blob)), identities...)
+	if err != nil {
+		return nil, fmt.Errorf("age decrypt: %w", err)
+	}
+
+	return io.ReadAll(r)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,7 +8,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -38,8 +36,45 @@ var (
 	k8sInCluster       bool
 	outputFile         string
 	inputFile          string
+
+	vaultCACert         string
+	vaultClientCert     string
+	vaultClientKey      string
+	vaultTLSServerName  string
+	vaultSkipVerifyFlag bool
+
+	daemonMode   bool
+	pollInterval time.Duration
+	listenAddr   string
+
+	kmsProvider     string
+	kmsKeyID        string
+	kmsIdentityFile string
+
+	shareDestinationURIs stringSliceFlag
+
+	sealType          string
+	recoveryShares    int
+	recoveryThreshold int
+
+	rotateRootToken bool
+	regenerateRoot  bool
 )
 
+// stringSliceFlag collects repeated occurrences of the same flag (e.g.
+// -share-destination a -share-destination b) into a slice, since the
+// standard flag package has no built-in repeated-flag type.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func init() {
 	flag.IntVar(&secretShares, "secret-shares", 5, "Number of master keys")
 	flag.IntVar(&secretThreshold, "secret-threshold", 3, "Number of master keys you need to unseal the Vault")
@@ -49,6 +84,53 @@ func init() {
 	flag.BoolVar(&k8sInCluster, "k8s-in-cluster", false, "are we running in cluster ?")
 	flag.StringVar(&k8sSecretNamespace, "k8s-ns", "default", "Name of the k8s ns the secret is stored in")
 	flag.StringVar(&k8sSecretName, "k8s-secret-name", "vault-unseal", "Name of the vault secret unseal")
+
+	flag.StringVar(&vaultCACert, "vault-ca-cert", "", "Path to a PEM encoded CA certificate to trust when talking to Vault over HTTPS (defaults to $VAULT_CACERT)")
+	flag.StringVar(&vaultClientCert, "vault-client-cert", "", "Path to a PEM encoded client certificate for mTLS (defaults to $VAULT_CLIENT_CERT)")
+	flag.StringVar(&vaultClientKey, "vault-client-key", "", "Path to the private key matching -vault-client-cert (defaults to $VAULT_CLIENT_KEY)")
+	flag.StringVar(&vaultTLSServerName, "vault-tls-server-name", "", "Name to use as the SNI host and for certificate verification instead of the hostname in the Vault address")
+	flag.BoolVar(&vaultSkipVerifyFlag, "vault-skip-verify", false, "Disable TLS certificate verification when talking to Vault (defaults to $VAULT_SKIP_VERIFY, insecure)")
+
+	flag.BoolVar(&daemonMode, "daemon", false, "Keep running and re-unseal Vault whenever it reports sealed instead of exiting after the first check")
+	flag.DurationVar(&pollInterval, "poll-interval", 30*time.Second, "How often to poll Vault's seal status in -daemon mode")
+	flag.StringVar(&listenAddr, "listen-addr", ":9102", "Address to serve /healthz, /readyz and /metrics on in -daemon mode")
+
+	flag.StringVar(&kmsProvider, "kms-provider", "", "Envelope-encrypt the init result with this KMS provider before persisting it (aws, gcp, azure, age), empty stores it in plaintext")
+	flag.StringVar(&kmsKeyID, "kms-key-id", "", "Provider-specific key identifier: a key ARN for aws, a CryptoKey resource name for gcp, a key vault key URL for azure, or comma-separated age recipients for age")
+	flag.StringVar(&kmsIdentityFile, "kms-identity-file", "", "Path to an age identity file, required to unseal when -kms-provider=age")
+
+	flag.Var(&shareDestinationURIs, "share-destination", "A destination to store one unseal key share in (k8s-secret://ns/name, file:///path, aws-secretsmanager://secret-id, vault://mount/path); repeat once per -secret-shares, one share per destination")
+
+	flag.StringVar(&sealType, "seal-type", "", "Vault seal type: \"shamir\" or \"auto\" (transit/awskms/gcpckms/azurekeyvault); auto-detected from /v1/sys/seal-status when unset")
+	flag.IntVar(&recoveryShares, "recovery-shares", 5, "Number of recovery key shares to request when initializing an auto-unseal (-seal-type=auto) Vault")
+	flag.IntVar(&recoveryThreshold, "recovery-threshold", 3, "Number of recovery key shares needed to perform a root token recovery on an auto-unseal (-seal-type=auto) Vault")
+
+	flag.BoolVar(&rotateRootToken, "rotate-root-token", false, "After a fresh init, prove the stored keys can recover a root token via generate-root, then revoke the root token and store a limited-lifetime admin token in its place")
+	flag.BoolVar(&regenerateRoot, "regenerate-root", false, "Run the generate-root OTP/nonce dance against the stored unseal/recovery keys to recover a working root token, print it, and exit")
+}
+
+// effectiveSealType returns the seal type to drive init/unseal behaviour:
+// flagVal if set, otherwise "shamir" when Vault reports a shamir (or
+// unset) seal type and "auto" for anything else (transit, awskms,
+// gcpckms, azurekeyvault, ...).
+func effectiveSealType(flagVal, statusType string) string {
+	if flagVal != "" {
+		return flagVal
+	}
+	if statusType == "" || statusType == "shamir" {
+		return "shamir"
+	}
+	return "auto"
+}
+
+// envOrDefault returns val if it is non-empty, otherwise the value of the
+// given environment variable, mirroring how the official vault CLI lets
+// environment variables fill in unset flags.
+func envOrDefault(val, envKey string) string {
+	if val != "" {
+		return val
+	}
+	return os.Getenv(envKey)
 }
 
 type VaultStatus struct {
@@ -60,16 +142,27 @@ type VaultStatus struct {
 	ClusterName string `json:"cluster_name"`
 	Version     string `json:"version"`
 	ClusterID   string `json:"cluster_id"`
+	// Type is the configured seal type, e.g. "shamir", "transit",
+	// "awskms", "gcpckms" or "azurekeyvault". Auto-unseal seals report
+	// anything other than "shamir" here.
+	Type string `json:"type"`
 }
 
+// VaultInitRequest is sent to /v1/sys/init. For a Shamir seal, set
+// SecretShares/SecretThreshold; for an auto-unseal seal, set
+// RecoveryShares/RecoveryThreshold instead and leave the secret fields
+// at zero.
 type VaultInitRequest struct {
-	SecretShares    int `json:"secret_shares"`
-	SecretThreshold int `json:"secret_threshold"`
+	SecretShares      int `json:"secret_shares,omitempty"`
+	SecretThreshold   int `json:"secret_threshold,omitempty"`
+	RecoveryShares    int `json:"recovery_shares,omitempty"`
+	RecoveryThreshold int `json:"recovery_threshold,omitempty"`
 }
 
 type VaultInitResponse struct {
-	Keys      []string `json:"keys"`
-	RootToken string   `json:"root_token"`
+	Keys         []string `json:"keys"`
+	RootToken    string   `json:"root_token"`
+	RecoveryKeys []string `json:"recovery_keys,omitempty"`
 }
 
 type VaultUnsealRequest struct {
@@ -80,157 +173,51 @@ type VaultUnsealResponse struct {
 	Sealed bool `json:"sealed"`
 }
 
-func initializeVault(vaultAddr string, shares int, threshold int) (*VaultInitResponse, error) {
-	var vaultResponse VaultInitResponse
-
-	initRequest := VaultInitRequest{
-		SecretShares:    shares,
-		SecretThreshold: threshold,
-	}
-
-	b, err := json.Marshal(&initRequest)
-	if err != nil {
-		return nil, err
-	}
-
-	c := http.Client{}
-
-	req, err := http.NewRequest("PUT", strings.TrimRight(vaultAddr, "/")+"/v1/sys/init", bytes.NewReader(b))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Add("Content-Type", "application/json")
-
-	resp, err := c.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	b, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	err = json.Unmarshal(b, &vaultResponse)
-	if err != nil {
-		return nil, err
-	}
-
-	return &vaultResponse, nil
-}
-
-func vaultStatus(vaultAddr string) (*VaultStatus, error) {
-	c := http.Client{}
-
-	req, err := http.NewRequest("GET", strings.TrimRight(vaultAddr, "/")+"/v1/sys/seal-status", nil)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := c.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var status VaultStatus
-	err = json.Unmarshal(b, &status)
-	if err != nil {
-		return nil, err
-	}
-
-	return &status, nil
-}
-
-func unsealVault(vaultAddr string, keys []string) (bool, error) {
-	c := http.Client{}
-
-	for i := 0; i < len(keys); i++ {
-		var vaultResponse VaultUnsealResponse
-
-		unsealRequest := VaultUnsealRequest{
-			Key: keys[i],
-		}
-
-		b, err := json.Marshal(&unsealRequest)
-		if err != nil {
-			return false, err
-		}
-
-		req, err := http.NewRequest("PUT", strings.TrimRight(vaultAddr, "/")+"/v1/sys/unseal", bytes.NewBuffer(b))
-		if err != nil {
-			return false, err
-		}
-
-		resp, err := c.Do(req)
-		if err != nil {
-			return false, err
-		}
-
-		defer resp.Body.Close()
-
-		b, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return false, err
-		}
-
-		err = json.Unmarshal(b, &vaultResponse)
-		if err != nil {
-			return false, err
-		}
-
-		if !vaultResponse.Sealed {
-			return true, nil
-		}
-	}
-
-	return false, errors.New("could not unseal vault")
-}
+func readConf(ctx context.Context, client *kubernetes.Clientset, protector KeyProtector, filePath string, k8sNs string, k8sName string) (*VaultInitResponse, error) {
+	var b []byte
+	var err error
 
-func readConf(ctx context.Context, client *kubernetes.Clientset, filePath string, k8sNs string, k8sName string) (*VaultInitResponse, error) {
 	if client == nil {
-		var initResult VaultInitResponse
-		b, err := ioutil.ReadFile(inputFile)
+		b, err = ioutil.ReadFile(inputFile)
 		if err != nil {
 			return nil, err
 		}
-		err = json.Unmarshal(b, &initResult)
+	} else {
+		secret, err := client.CoreV1().Secrets(k8sNs).Get(ctx, k8sName, metav1.GetOptions{})
 		if err != nil {
 			return nil, err
 		}
-
-		return &initResult, nil
+		b = secret.Data["value"]
 	}
 
-	secret, err := client.CoreV1().Secrets(k8sNs).Get(ctx, k8sName, metav1.GetOptions{})
-	if err != nil {
-		return nil, err
+	if protector != nil {
+		b, err = openEnvelope(ctx, protector, b)
+		if err != nil {
+			return nil, fmt.Errorf("could not open kms envelope: %w", err)
+		}
 	}
 
 	var initResult VaultInitResponse
-	err = json.Unmarshal(secret.Data["value"], &initResult)
-	if err != nil {
+	if err := json.Unmarshal(b, &initResult); err != nil {
 		return nil, err
 	}
 
 	return &initResult, nil
 }
 
-func writeConf(ctx context.Context, client *kubernetes.Clientset, filePath string, k8sNs string, k8sName string, initResult VaultInitResponse) error {
+func writeConf(ctx context.Context, client *kubernetes.Clientset, protector KeyProtector, filePath string, k8sNs string, k8sName string, initResult VaultInitResponse) error {
 	b, err := json.Marshal(&initResult)
 	if err != nil {
 		return fmt.Errorf("could not marshal the result: %w", err)
 	}
 
+	if protector != nil {
+		b, err = sealEnvelope(ctx, protector, b)
+		if err != nil {
+			return fmt.Errorf("could not seal kms envelope: %w", err)
+		}
+	}
+
 	if client == nil {
 		err = ioutil.WriteFile(outputFile, b, 0640)
 		if err != nil {
@@ -295,14 +282,51 @@ func main() {
 		}
 	}
 
+	skipVerify := vaultSkipVerifyFlag || strings.EqualFold(os.Getenv("VAULT_SKIP_VERIFY"), "true")
+
+	vault, err := NewVaultClient(
+		vaultAddr,
+		envOrDefault(vaultCACert, "VAULT_CACERT"),
+		envOrDefault(vaultClientCert, "VAULT_CLIENT_CERT"),
+		envOrDefault(vaultClientKey, "VAULT_CLIENT_KEY"),
+		vaultTLSServerName,
+		skipVerify,
+	)
+	if err != nil {
+		log.Fatalf("could not build vault client: %s\n", err)
+	}
+
+	protector, err := NewKeyProtector(kmsProvider, kmsKeyID, kmsIdentityFile)
+	if err != nil {
+		log.Fatalf("could not build kms protector: %s\n", err)
+	}
+
+	var shareDestinations []ShareDestination
+	if len(shareDestinationURIs) > 0 {
+		if len(shareDestinationURIs) != secretShares {
+			log.Fatalf("got %d -share-destination flags but -secret-shares is %d, they must match\n", len(shareDestinationURIs), secretShares)
+		}
+		for _, uri := range shareDestinationURIs {
+			dest, err := NewShareDestination(uri, clientset, vault)
+			if err != nil {
+				log.Fatalf("could not build share destination %q: %s\n", uri, err)
+			}
+			shareDestinations = append(shareDestinations, dest)
+		}
+	}
+
+	if regenerateRoot {
+		runRegenerateRoot(vault, clientset, protector, shareDestinations, inputFile, k8sSecretNamespace, k8sSecretName)
+		return
+	}
+
 	log.Printf("waiting for vault to be ready at %s\n", vaultAddr)
 
 	var status *VaultStatus
-	var err error
 
 	// wait for vault to be ready (up and such)
 	for {
-		status, err = vaultStatus(vaultAddr)
+		status, err = vault.Status()
 		if err != nil {
 			log.Printf("vault is not ready yet: %s\n", err)
 			time.Sleep(time.Second * 1)
@@ -313,37 +337,163 @@ func main() {
 
 	log.Printf("vault is sealed: %v, vault is initialized: %v", status.Sealed, status.Initialized)
 
-	// initialize vault if it is not initialized yet
+	if _, err := reconcile(vault, clientset, protector, shareDestinations, inputFile, k8sSecretNamespace, k8sSecretName); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	if !daemonMode {
+		return
+	}
+
+	daemon := NewDaemon(vault, clientset, protector, shareDestinations, pollInterval, inputFile, k8sSecretNamespace, k8sSecretName)
+	if err := daemon.ServeHTTP(listenAddr); err != nil {
+		log.Fatalf("could not start health/metrics server: %s\n", err)
+	}
+
+	log.Printf("running in daemon mode, polling every %s, serving /healthz, /readyz and /metrics on %s\n", pollInterval, listenAddr)
+	if err := daemon.Run(context.Background()); err != nil {
+		log.Fatalf("daemon stopped: %s\n", err)
+	}
+}
+
+// runRegenerateRoot drives the full generate-root OTP/nonce dance using
+// the stored unseal (or recovery) keys and prints the resulting root
+// token, so an operator can recover admin access without ever keeping a
+// live root token around.
+func runRegenerateRoot(vault *VaultClient, clientset *kubernetes.Clientset, protector KeyProtector, shareDestinations []ShareDestination, inputFile, k8sNs, k8sName string) {
+	status, err := vault.Status()
+	if err != nil {
+		log.Fatalf("could not get vault status: %s\n", err)
+	}
+
+	seal := effectiveSealType(sealType, status.Type)
+	threshold := secretThreshold
+	if seal == "auto" {
+		threshold = recoveryThreshold
+	}
+
+	var initResult *VaultInitResponse
+	if len(shareDestinations) > 0 {
+		initResult, err = readShares(context.Background(), shareDestinations, protector, threshold)
+	} else {
+		initResult, err = readConf(context.Background(), clientset, protector, inputFile, k8sNs, k8sName)
+	}
+	if err != nil {
+		log.Fatalf("could not read stored keys: %s\n", err)
+	}
+
+	keys := initResult.Keys
+	if seal == "auto" {
+		keys = initResult.RecoveryKeys
+	}
+
+	token, err := runGenerateRoot(vault, keys, threshold)
+	if err != nil {
+		log.Fatalf("could not regenerate root token: %s\n", err)
+	}
+
+	fmt.Println(token)
+}
+
+// reconcile brings Vault to an initialized state and, for a Shamir seal,
+// an unsealed one too: it initializes Vault if needed (persisting the
+// result through writeConf/writeShares), then unseals it if it is
+// currently sealed (reading keys back through readConf/readShares). An
+// auto-unseal seal (seal-type "auto") never needs the unseal step, so it
+// is skipped for those; it also rejects shareDestinations outright,
+// since there are no Shamir keys to split across them. It returns the
+// seal status observed before any unseal attempt.
+func reconcile(vault *VaultClient, clientset *kubernetes.Clientset, protector KeyProtector, shareDestinations []ShareDestination, inputFile, k8sNs, k8sName string) (*VaultStatus, error) {
+	status, err := vault.Status()
+	if err != nil {
+		return nil, fmt.Errorf("could not get vault status: %w", err)
+	}
+
+	seal := effectiveSealType(sealType, status.Type)
+
+	if seal == "auto" && len(shareDestinations) > 0 {
+		return status, errors.New("-share-destination is only supported for shamir seals, not seal-type=auto (recovery keys are not distributable through it)")
+	}
+
 	if !status.Initialized {
-		log.Printf("initializing vault with %d shares and a threshold of %d\n", secretShares, secretThreshold)
-		initResult, err := initializeVault(vaultAddr, secretShares, secretThreshold)
-		if err != nil {
-			log.Fatalf("could not initialize vault: %s\n", err)
+		var initRequest VaultInitRequest
+		if seal == "auto" {
+			log.Printf("initializing vault (auto-unseal) with %d recovery shares and a threshold of %d\n", recoveryShares, recoveryThreshold)
+			initRequest = VaultInitRequest{RecoveryShares: recoveryShares, RecoveryThreshold: recoveryThreshold}
+		} else {
+			log.Printf("initializing vault with %d shares and a threshold of %d\n", secretShares, secretThreshold)
+			initRequest = VaultInitRequest{SecretShares: secretShares, SecretThreshold: secretThreshold}
 		}
 
-		err = writeConf(context.Background(), clientset, outputFile, k8sSecretNamespace, k8sSecretName, *initResult)
+		initResult, err := vault.Init(initRequest)
 		if err != nil {
-			log.Fatalf("could not save init result: %s\n", err)
+			return status, fmt.Errorf("could not initialize vault: %w", err)
+		}
+
+		if rotateRootToken {
+			rotationKeys := initResult.Keys
+			rotationThreshold := secretThreshold
+			if seal == "auto" {
+				rotationKeys = initResult.RecoveryKeys
+				rotationThreshold = recoveryThreshold
+			}
+
+			if err := RotateRootToken(vault, initResult, rotationKeys, rotationThreshold); err != nil {
+				log.Printf("could not rotate root token, leaving it in place: %s\n", err)
+			}
+		}
+
+		if len(shareDestinations) > 0 {
+			if err := writeShares(context.Background(), shareDestinations, protector, *initResult); err != nil {
+				return status, fmt.Errorf("could not save init result: %w", err)
+			}
+		} else if err := writeConf(context.Background(), clientset, protector, outputFile, k8sNs, k8sName, *initResult); err != nil {
+			return status, fmt.Errorf("could not save init result: %w", err)
 		}
 	}
 
-	// unseal vault if it is not unsealed yet
+	if seal == "auto" {
+		if status.Sealed {
+			log.Println("vault uses an auto-unseal seal, no unseal step needed")
+		}
+		return status, nil
+	}
+
 	if status.Sealed {
 		log.Println("unsealing vault")
-		initResult, err := readConf(context.Background(), clientset, inputFile, k8sSecretNamespace, k8sSecretName)
+		metricUnsealAttemptsTotal.Inc()
+
+		var initResult *VaultInitResponse
+		if len(shareDestinations) > 0 {
+			initResult, err = readShares(context.Background(), shareDestinations, protector, secretThreshold)
+		} else {
+			initResult, err = readConf(context.Background(), clientset, protector, inputFile, k8sNs, k8sName)
+		}
 		if err != nil {
-			panic(err)
+			return status, &unsealError{fmt.Errorf("could not read unseal keys: %w", err)}
 		}
 
-		unsealed, err := unsealVault(vaultAddr, initResult.Keys)
+		unsealed, err := vault.Unseal(initResult.Keys)
 		if err != nil {
-			log.Fatalf("could not unseal vault: %s\n", err)
+			return status, &unsealError{fmt.Errorf("could not unseal vault: %w", err)}
 		}
-		if unsealed {
-			log.Println("vault successfully unsealed")
-		} else {
-			log.Println("failed to unseal vault")
-			os.Exit(1)
+		if !unsealed {
+			return status, &unsealError{errors.New("failed to unseal vault")}
 		}
+		log.Println("vault successfully unsealed")
 	}
+
+	return status, nil
 }
+
+// unsealError wraps an error encountered while actually attempting to
+// unseal Vault, as opposed to errors from checking its status,
+// initializing it, or persisting init results. Daemon.Run uses this to
+// scope vault_unseal_errors_total to genuine unseal failures instead of
+// every way reconcile can fail.
+type unsealError struct {
+	err error
+}
+
+func (e *unsealError) Error() string { return e.err.Error() }
+func (e *unsealError) Unwrap() error { return e.err }
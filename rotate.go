@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// createTokenRequest is sent to /v1/auth/token/create-orphan.
+type createTokenRequest struct {
+	Policies    []string `json:"policies,omitempty"`
+	TTL         string   `json:"ttl,omitempty"`
+	DisplayName string   `json:"display_name,omitempty"`
+}
+
+type createTokenResponse struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+// adminPolicyName is the policy RotateRootToken attaches to the
+// limited-lifetime token it mints in place of the root token. It grants
+// the same blanket capabilities as root so that token can actually
+// stand in for it, just on a short TTL instead of forever.
+const adminPolicyName = "unseal-vault-admin"
+
+const adminPolicyHCL = `
+path "*" {
+  capabilities = ["create", "read", "update", "delete", "list", "sudo"]
+}
+`
+
+// EnsureAdminPolicy creates or updates the adminPolicyName policy using
+// rootToken, so CreateToken can mint tokens that carry real admin
+// capability instead of the default, near-powerless policy.
+func (c *VaultClient) EnsureAdminPolicy(rootToken string) error {
+	b, err := json.Marshal(map[string]string{"policy": adminPolicyHCL})
+	if err != nil {
+		return err
+	}
+	return c.doWithToken("PUT", "/v1/sys/policy/"+adminPolicyName, rootToken, b, nil)
+}
+
+// CreateToken creates a limited-lifetime orphan token authenticated as
+// rootToken, standing in for the root token for routine admin work. It
+// has no parent, so revoking rootToken does not revoke it.
+func (c *VaultClient) CreateToken(rootToken string, policies []string, ttl string) (string, error) {
+	req := createTokenRequest{
+		Policies:    policies,
+		TTL:         ttl,
+		DisplayName: "unseal-vault-admin",
+	}
+
+	b, err := json.Marshal(&req)
+	if err != nil {
+		return "", err
+	}
+
+	var resp createTokenResponse
+	if err := c.doWithToken("POST", "/v1/auth/token/create-orphan", rootToken, b, &resp); err != nil {
+		return "", err
+	}
+
+	return resp.Auth.ClientToken, nil
+}
+
+// RevokeSelf revokes token, invalidating it immediately.
+func (c *VaultClient) RevokeSelf(token string) error {
+	return c.doWithToken("POST", "/v1/auth/token/revoke-self", token, nil, nil)
+}
+
+// GenerateRootStatus mirrors the /v1/sys/generate-root response.
+type GenerateRootStatus struct {
+	Started      bool   `json:"started"`
+	Nonce        string `json:"nonce"`
+	Progress     int    `json:"progress"`
+	Required     int    `json:"required"`
+	Complete     bool   `json:"complete"`
+	EncodedToken string `json:"encoded_token"`
+	OTP          string `json:"otp"`
+	OTPLength    int    `json:"otp_length"`
+}
+
+// GenerateRootInit starts a new generate-root attempt using Vault's
+// built-in OTP mode and returns the nonce/OTP that must accompany every
+// subsequent key submission.
+func (c *VaultClient) GenerateRootInit() (*GenerateRootStatus, error) {
+	var status GenerateRootStatus
+	if err := c.do("PUT", "/v1/sys/generate-root/attempt", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+type generateRootUpdateRequest struct {
+	Key   string `json:"key"`
+	Nonce string `json:"nonce"`
+}
+
+// GenerateRootUpdate submits one unseal/recovery key toward an in
+// progress generate-root attempt.
+func (c *VaultClient) GenerateRootUpdate(key, nonce string) (*GenerateRootStatus, error) {
+	b, err := json.Marshal(&generateRootUpdateRequest{Key: key, Nonce: nonce})
+	if err != nil {
+		return nil, err
+	}
+
+	var status GenerateRootStatus
+	if err := c.do("PUT", "/v1/sys/generate-root/update", b, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// GenerateRootCancel aborts any in-progress generate-root attempt.
+func (c *VaultClient) GenerateRootCancel() error {
+	return c.do("DELETE", "/v1/sys/generate-root/attempt", nil, nil)
+}
+
+// decodeGeneratedRoot XORs the base64-encoded generate-root result with
+// the OTP Vault handed out for the attempt, which is how Vault's own OTP
+// mode recovers the plaintext root token without ever putting it on the
+// wire directly. Vault encodes encoded_token without padding, so this
+// must use RawStdEncoding rather than StdEncoding.
+func decodeGeneratedRoot(encodedToken, otp string) (string, error) {
+	tokenBytes, err := base64.RawStdEncoding.DecodeString(encodedToken)
+	if err != nil {
+		return "", fmt.Errorf("could not decode encoded_token: %w", err)
+	}
+
+	otpBytes := []byte(otp)
+	if len(otpBytes) != len(tokenBytes) {
+		return "", fmt.Errorf("otp length (%d) does not match encoded token length (%d)", len(otpBytes), len(tokenBytes))
+	}
+
+	out := make([]byte, len(tokenBytes))
+	for i := range tokenBytes {
+		out[i] = tokenBytes[i] ^ otpBytes[i]
+	}
+
+	return string(out), nil
+}
+
+// runGenerateRoot drives a full generate-root attempt to completion by
+// submitting threshold keys one at a time, and returns the recovered
+// root token. Any attempt left over from a previous, failed run is
+// cancelled first so this is safe to retry; the attempt it starts is
+// likewise cancelled on every error path instead of being left open,
+// which would otherwise make Vault refuse the next retry with "attempt
+// already in progress".
+func runGenerateRoot(vault *VaultClient, keys []string, threshold int) (string, error) {
+	if len(keys) < threshold {
+		return "", fmt.Errorf("need %d keys to generate a root token, only have %d", threshold, len(keys))
+	}
+
+	if err := vault.GenerateRootCancel(); err != nil {
+		log.Printf("could not cancel a possibly stale generate-root attempt, continuing anyway: %s\n", err)
+	}
+
+	status, err := vault.GenerateRootInit()
+	if err != nil {
+		return "", fmt.Errorf("could not start generate-root attempt: %w", err)
+	}
+
+	for i := 0; i < threshold && !status.Complete; i++ {
+		status, err = vault.GenerateRootUpdate(keys[i], status.Nonce)
+		if err != nil {
+			if cancelErr := vault.GenerateRootCancel(); cancelErr != nil {
+				log.Printf("could not cancel the failed generate-root attempt: %s\n", cancelErr)
+			}
+			return "", fmt.Errorf("could not submit key %d to generate-root: %w", i, err)
+		}
+	}
+
+	if !status.Complete {
+		if cancelErr := vault.GenerateRootCancel(); cancelErr != nil {
+			log.Printf("could not cancel the incomplete generate-root attempt: %s\n", cancelErr)
+		}
+		return "", errors.New("generate-root did not complete after submitting the required number of keys")
+	}
+
+	return decodeGeneratedRoot(status.EncodedToken, status.OTP)
+}
+
+// RotateRootToken is run once, right after a fresh init, when
+// -rotate-root-token is set. It ensures an admin policy exists and mints
+// a limited-lifetime token carrying it, proves the stored keys can
+// regenerate the root token through a real generate-root attempt,
+// revokes both the token that attempt produced and the original root
+// token, then replaces initResult.RootToken with the limited-lifetime
+// admin token so it (and not the revoked root token) is what ends up
+// persisted.
+func RotateRootToken(vault *VaultClient, initResult *VaultInitResponse, keys []string, threshold int) error {
+	if err := vault.EnsureAdminPolicy(initResult.RootToken); err != nil {
+		return fmt.Errorf("could not create admin policy: %w", err)
+	}
+
+	adminToken, err := vault.CreateToken(initResult.RootToken, []string{adminPolicyName}, "720h")
+	if err != nil {
+		return fmt.Errorf("could not create admin token: %w", err)
+	}
+	log.Println("created a 720h limited-lifetime admin token to use instead of the root token going forward")
+
+	generatedToken, err := runGenerateRoot(vault, keys, threshold)
+	if err != nil {
+		return fmt.Errorf("generate-root dry run failed, refusing to revoke the root token: %w", err)
+	}
+	log.Println("generate-root dry run succeeded: the stored keys can recover a root token")
+
+	if err := vault.RevokeSelf(generatedToken); err != nil {
+		return fmt.Errorf("generate-root dry run produced a live root token that could not be revoked: %w", err)
+	}
+
+	if err := vault.RevokeSelf(initResult.RootToken); err != nil {
+		return fmt.Errorf("could not revoke root token: %w", err)
+	}
+
+	initResult.RootToken = adminToken
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecodeGeneratedRoot(t *testing.T) {
+	want := "s.exampletoken12"
+	otp := "otpotpotpotpotp1"
+	if len(want) != len(otp) {
+		t.Fatalf("test fixture bug: token and otp must be the same length")
+	}
+
+	xored := make([]byte, len(want))
+	for i := range xored {
+		xored[i] = want[i] ^ otp[i]
+	}
+	// Vault encodes encoded_token without padding; the fixture mirrors
+	// that so this test catches a regression to padded StdEncoding.
+	encoded := base64.RawStdEncoding.EncodeToString(xored)
+
+	got, err := decodeGeneratedRoot(encoded, otp)
+	if err != nil {
+		t.Fatalf("decodeGeneratedRoot: %s", err)
+	}
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestDecodeGeneratedRootLengthMismatch(t *testing.T) {
+	encoded := base64.RawStdEncoding.EncodeToString([]byte("short"))
+	if _, err := decodeGeneratedRoot(encoded, "much-longer-otp-string"); err == nil {
+		t.Fatal("expected an error on otp/token length mismatch")
+	}
+}
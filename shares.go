@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// shareRecord is what actually gets written to a single --share-destination:
+// one of the N Shamir key shares returned by Vault's init call, plus,
+// alongside share zero, the root token needed to recover admin access.
+// RootToken is never stored in the clear: when a KeyProtector is
+// configured it holds a base64-encoded KMS envelope (see sealEnvelope);
+// otherwise it is left blank, since a single compromised destination
+// must not be enough to hand out a live root token.
+type shareRecord struct {
+	Index     int    `json:"index"`
+	Share     string `json:"share"`
+	RootToken string `json:"root_token,omitempty"`
+}
+
+// ShareDestination stores or retrieves a single key share, so that the N
+// shares making up a Shamir threshold can be spread across independently
+// controlled trust domains instead of a single Secret.
+type ShareDestination interface {
+	WriteShare(ctx context.Context, record shareRecord) error
+	ReadShare(ctx context.Context) (*shareRecord, error)
+}
+
+// NewShareDestination parses a --share-destination URI and builds the
+// matching ShareDestination. Supported schemes: k8s-secret://ns/name,
+// file:///path/to/share, aws-secretsmanager://secret-id and
+// vault://path/to/secret (written as a plain KV payload against the
+// configured Vault, intended for a separate key-custody Vault rather
+// than the one being unsealed).
+func NewShareDestination(uri string, clientset *kubernetes.Clientset, vault *VaultClient) (ShareDestination, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse share destination %q: %w", uri, err)
+	}
+
+	switch parsed.Scheme {
+	case "file":
+		return &fileShareDestination{path: parsed.Host + parsed.Path}, nil
+	case "k8s-secret":
+		ns := parsed.Host
+		name := strings.TrimPrefix(parsed.Path, "/")
+		if ns == "" || name == "" {
+			return nil, fmt.Errorf("k8s-secret share destination %q must be of the form k8s-secret://namespace/name", uri)
+		}
+		return &k8sShareDestination{clientset: clientset, namespace: ns, name: name}, nil
+	case "aws-secretsmanager":
+		secretID := parsed.Host + parsed.Path
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("could not load aws config: %w", err)
+		}
+		return &awsSecretsManagerShareDestination{client: secretsmanager.NewFromConfig(cfg), secretID: secretID}, nil
+	case "vault":
+		return &vaultShareDestination{vault: vault, path: strings.TrimPrefix(parsed.Path, "/"), host: parsed.Host}, nil
+	default:
+		return nil, fmt.Errorf("unsupported share destination scheme %q in %q", parsed.Scheme, uri)
+	}
+}
+
+type fileShareDestination struct {
+	path string
+}
+
+func (d *fileShareDestination) WriteShare(ctx context.Context, record shareRecord) error {
+	b, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.path, b, 0640)
+}
+
+func (d *fileShareDestination) ReadShare(ctx context.Context) (*shareRecord, error) {
+	b, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+	var record shareRecord
+	if err := json.Unmarshal(b, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+type k8sShareDestination struct {
+	clientset *kubernetes.Clientset
+	namespace string
+	name      string
+}
+
+func (d *k8sShareDestination) WriteShare(ctx context.Context, record shareRecord) error {
+	b, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: d.name,
+		},
+		Data: map[string][]byte{
+			"value": b,
+		},
+	}
+
+	_, err = d.clientset.CoreV1().Secrets(d.namespace).Create(ctx, secret, metav1.CreateOptions{})
+	return err
+}
+
+func (d *k8sShareDestination) ReadShare(ctx context.Context) (*shareRecord, error) {
+	secret, err := d.clientset.CoreV1().Secrets(d.namespace).Get(ctx, d.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var record shareRecord
+	if err := json.Unmarshal(secret.Data["value"], &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+type awsSecretsManagerShareDestination struct {
+	client   *secretsmanager.Client
+	secretID string
+}
+
+func (d *awsSecretsManagerShareDestination) WriteShare(ctx context.Context, record shareRecord) error {
+	b, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	value := string(b)
+
+	_, err = d.client.CreateSecret(ctx, &secretsmanager.CreateSecretInput{
+		Name:         aws.String(d.secretID),
+		SecretString: aws.String(value),
+	})
+	return err
+}
+
+func (d *awsSecretsManagerShareDestination) ReadShare(ctx context.Context) (*shareRecord, error) {
+	out, err := d.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(d.secretID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var record shareRecord
+	if err := json.Unmarshal([]byte(aws.ToString(out.SecretString)), &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// vaultShareDestination stores a share as a plain KV payload against a
+// Vault instance reachable through the same VaultClient. It is meant to
+// point at a separate, already-unsealed key-custody Vault rather than
+// the one being initialized/unsealed by this tool.
+type vaultShareDestination struct {
+	vault *VaultClient
+	host  string
+	path  string
+}
+
+func (d *vaultShareDestination) fullPath() string {
+	return "/v1/" + strings.TrimSuffix(d.host, "/") + "/" + d.path
+}
+
+func (d *vaultShareDestination) WriteShare(ctx context.Context, record shareRecord) error {
+	b, err := json.Marshal(map[string]shareRecord{"data": record})
+	if err != nil {
+		return err
+	}
+	var out map[string]interface{}
+	return d.vault.do("PUT", d.fullPath(), b, &out)
+}
+
+func (d *vaultShareDestination) ReadShare(ctx context.Context) (*shareRecord, error) {
+	// WriteShare nests the record under "data", so it comes back as
+	// data.data in the read response.
+	var resp struct {
+		Data struct {
+			Data shareRecord `json:"data"`
+		} `json:"data"`
+	}
+	if err := d.vault.do("GET", d.fullPath(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data.Data, nil
+}
+
+// writeShares splits initResult.Keys one per destination (destinations
+// must have exactly len(initResult.Keys) entries). If protector is set,
+// the root token is KMS-sealed and the envelope is stored alongside
+// share zero; otherwise no destination receives the root token at all,
+// since handing it out in the clear would make any single compromised
+// destination enough to recover full admin access. --rotate-root-token
+// does not blank initResult.RootToken: it replaces it with a
+// limited-lifetime admin token, which is stored or withheld by the same
+// rule. Without --kms-provider, admin access after init is recovered
+// from the stored shares with --regenerate-root.
+func writeShares(ctx context.Context, destinations []ShareDestination, protector KeyProtector, initResult VaultInitResponse) error {
+	if len(destinations) != len(initResult.Keys) {
+		return fmt.Errorf("got %d share destinations but vault returned %d keys", len(destinations), len(initResult.Keys))
+	}
+
+	rootToken := ""
+	if initResult.RootToken != "" {
+		if protector == nil {
+			log.Println("warning: no -kms-provider configured, refusing to store the plaintext root token in a share destination; use -kms-provider to store it, or -regenerate-root to recover admin access later")
+		} else {
+			sealed, err := sealEnvelope(ctx, protector, []byte(initResult.RootToken))
+			if err != nil {
+				return fmt.Errorf("could not seal root token for share distribution: %w", err)
+			}
+			rootToken = base64.StdEncoding.EncodeToString(sealed)
+		}
+	}
+
+	for i, dest := range destinations {
+		record := shareRecord{Index: i, Share: initResult.Keys[i]}
+		if i == 0 {
+			record.RootToken = rootToken
+		}
+		if err := dest.WriteShare(ctx, record); err != nil {
+			return fmt.Errorf("could not write share %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// readShares reads back as many shares as it can and succeeds as soon as
+// threshold of them were readable, since that's all Vault needs to
+// unseal. The root token is recovered from whichever destination held
+// its KMS envelope; if no protector is configured it is left blank,
+// matching what writeShares stored.
+func readShares(ctx context.Context, destinations []ShareDestination, protector KeyProtector, threshold int) (*VaultInitResponse, error) {
+	result := &VaultInitResponse{}
+
+	for i, dest := range destinations {
+		record, err := dest.ReadShare(ctx)
+		if err != nil {
+			log.Printf("could not read share destination %d: %s\n", i, err)
+			continue
+		}
+
+		result.Keys = append(result.Keys, record.Share)
+		if record.RootToken != "" && protector != nil {
+			sealed, err := base64.StdEncoding.DecodeString(record.RootToken)
+			if err != nil {
+				log.Printf("could not decode sealed root token from share destination %d: %s\n", i, err)
+				continue
+			}
+			opened, err := openEnvelope(ctx, protector, sealed)
+			if err != nil {
+				log.Printf("could not open sealed root token from share destination %d: %s\n", i, err)
+				continue
+			}
+			result.RootToken = string(opened)
+		}
+	}
+
+	if len(result.Keys) < threshold {
+		return nil, fmt.Errorf("could only read %d of the %d required key shares", len(result.Keys), threshold)
+	}
+
+	return result, nil
+}
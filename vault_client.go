@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultClient wraps the handful of Vault HTTP API calls this tool needs
+// (init, seal-status, unseal, plus the policy, token and generate-root
+// calls in rotate.go) behind a single http.Client configured for
+// TLS, so every call shares the same CA trust, client certificate and
+// timeouts instead of dialing out with a bare http.Client{}.
+type VaultClient struct {
+	addr       string
+	httpClient *http.Client
+}
+
+// NewVaultClient builds a VaultClient for vaultAddr. caCertPath, when set,
+// becomes the client's only trusted CA (the system roots are not used);
+// clientCertPath/clientKeyPath,
+// when both set, are presented for mTLS. tlsServerName overrides the TLS
+// ServerName (useful when vaultAddr is an IP or load balancer hostname
+// that doesn't match the certificate's SAN), and skipVerify disables
+// certificate verification entirely for dev/test setups.
+func NewVaultClient(vaultAddr, caCertPath, clientCertPath, clientKeyPath, tlsServerName string, skipVerify bool) (*VaultClient, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         tlsServerName,
+		InsecureSkipVerify: skipVerify,
+	}
+
+	if caCertPath != "" {
+		caCert, err := ioutil.ReadFile(caCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read vault CA certificate: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("could not append %s to the CA pool", caCertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (clientCertPath == "") != (clientKeyPath == "") {
+		return nil, errors.New("vault-client-cert and vault-client-key must both be set to use client certificate authentication")
+	}
+
+	if clientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load vault client certificate/key: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &VaultClient{
+		addr: strings.TrimRight(vaultAddr, "/"),
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}, nil
+}
+
+func (c *VaultClient) do(method, path string, body []byte, out interface{}) error {
+	return c.doWithToken(method, path, "", body, out)
+}
+
+// doWithToken is like do but additionally sets the X-Vault-Token header
+// when token is non-empty, for calls that need to authenticate as the
+// root token or a derived admin token.
+func (c *VaultClient) doWithToken(method, path, token string, body []byte, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, c.addr+path, reader)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	if token != "" {
+		req.Header.Add("X-Vault-Token", token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: unexpected status %s: %s", method, path, resp.Status, string(b))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(b, out)
+}
+
+// Init initializes Vault with the given request, which carries either
+// secret shares/threshold (Shamir seal) or recovery shares/threshold
+// (auto-unseal seal).
+func (c *VaultClient) Init(initRequest VaultInitRequest) (*VaultInitResponse, error) {
+	b, err := json.Marshal(&initRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var vaultResponse VaultInitResponse
+	if err := c.do("PUT", "/v1/sys/init", b, &vaultResponse); err != nil {
+		return nil, err
+	}
+
+	return &vaultResponse, nil
+}
+
+// Status returns the current Vault seal status.
+func (c *VaultClient) Status() (*VaultStatus, error) {
+	var status VaultStatus
+	if err := c.do("GET", "/v1/sys/seal-status", nil, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// Unseal submits keys to Vault one at a time until it reports unsealed or
+// the keys are exhausted.
+func (c *VaultClient) Unseal(keys []string) (bool, error) {
+	for i := 0; i < len(keys); i++ {
+		unsealRequest := VaultUnsealRequest{
+			Key: keys[i],
+		}
+
+		b, err := json.Marshal(&unsealRequest)
+		if err != nil {
+			return false, err
+		}
+
+		var vaultResponse VaultUnsealResponse
+		if err := c.do("PUT", "/v1/sys/unseal", b, &vaultResponse); err != nil {
+			return false, err
+		}
+
+		if !vaultResponse.Sealed {
+			return true, nil
+		}
+	}
+
+	return false, errors.New("could not unseal vault")
+}